@@ -0,0 +1,121 @@
+// Package archive fetches full-content snapshots of articles so they
+// stay readable even if the source page disappears or changes.
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"redaer/store"
+)
+
+// maxArticleBytes caps how much of an article page (including the assets
+// referenced by it) we'll fetch and cache.  Runaway pages get truncated
+// rather than filling the archive directory.
+const maxArticleBytes = 10 << 20 // 10MB
+
+// FileArchiver fetches each new article's page, extracts its main
+// content, rewrites its asset URLs to be absolute, downloads those
+// assets, and writes the result to a per-article directory.  It doesn't
+// run its own worker pool or HTTP client; store.LinkStore calls Archive
+// once per link from one of CheckForUpdates' own goroutines, passing the
+// same client and host rate limiters the check itself used, so archiving
+// naturally shares that concurrency limit, timeout, and per-host
+// throttling instead of adding its own.
+type FileArchiver struct {
+	// Dir is the root directory snapshots are written under, one
+	// subdirectory per article keyed by a hash of its Url.
+	Dir string
+}
+
+// NewFileArchiver returns a FileArchiver rooted at dir.  dir isn't
+// created here; archiveOne creates it along with each article's
+// subdirectory the first time something is archived.
+func NewFileArchiver(dir string) *FileArchiver {
+	return &FileArchiver{Dir: dir}
+}
+
+// Archive implements store.Archiver.  It fetches and snapshots every
+// article on link that hasn't been archived yet, recording the result
+// on link.Archived and on the matching Article.ArchivePath.  A failure
+// archiving one article is logged and skipped rather than aborting the
+// rest.
+func (a *FileArchiver) Archive(ctx context.Context, client *http.Client, hosts *store.HostLimiters, link *store.LinkDetails) error {
+	if link.Archived == nil {
+		link.Archived = make(map[string]string)
+	}
+
+	for i := range link.Articles {
+		art := &link.Articles[i]
+		if path, ok := link.Archived[art.Url]; ok {
+			art.ArchivePath = path
+			continue
+		}
+
+		path, err := a.archiveOne(ctx, client, hosts, art.Url)
+		if err != nil {
+			log.Printf("archive: %s: %s\n", art.Url, err)
+			continue
+		}
+
+		link.Archived[art.Url] = path
+		art.ArchivePath = path
+	}
+
+	return nil
+}
+
+// archiveOne fetches articleUrl, extracts its main content, downloads
+// the assets it references, and writes a self-contained snapshot to a
+// directory keyed by a hash of articleUrl.  It returns the path to the snapshot's
+// index.html.
+func (a *FileArchiver) archiveOne(ctx context.Context, client *http.Client, hosts *store.HostLimiters, articleUrl string) (string, error) {
+	resp, err := store.Get(ctx, client, hosts, articleUrl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("bad response fetching %s: %s", articleUrl, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxArticleBytes))
+	if err != nil {
+		return "", err
+	}
+
+	content, err := extractContent(body)
+	if err != nil {
+		return "", err
+	}
+
+	dir := a.articleDir(articleUrl)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	budget := int64(maxArticleBytes) - int64(len(content))
+	content = rewriteAssetURLs(ctx, content, articleUrl, client, hosts, dir, &budget)
+
+	dst := filepath.Join(dir, "index.html")
+	if err := os.WriteFile(dst, content, 0644); err != nil {
+		return "", err
+	}
+
+	return dst, nil
+}
+
+// articleDir returns a per-article directory keyed by a content hash of
+// its Url, so re-archiving the same article is idempotent.
+func (a *FileArchiver) articleDir(articleUrl string) string {
+	sum := sha256.Sum256([]byte(articleUrl))
+	return filepath.Join(a.Dir, hex.EncodeToString(sum[:])[:16])
+}
@@ -0,0 +1,56 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"redaer/store"
+)
+
+// TestArchiveRewritesAssetURLs is a regression test for archiveOne
+// discarding rewriteAssetURLs' return value: the saved index.html must
+// reference the locally-downloaded copy of its image, not the original
+// remote URL.
+func TestArchiveRewritesAssetURLs(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/article":
+			fmt.Fprintf(w, `<html><body><article><p>words words words words words words</p>`+
+				`<img src="%s/pic.png"></article></body></html>`, srv.URL)
+		case "/pic.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("fake-png-bytes"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	a := NewFileArchiver(dir)
+
+	link := &store.LinkDetails{Articles: []store.Article{{Url: srv.URL + "/article"}}}
+	if err := a.Archive(context.Background(), &http.Client{}, nil, link); err != nil {
+		t.Fatalf("Archive: %s", err)
+	}
+
+	path := link.Articles[0].ArchivePath
+	if path == "" {
+		t.Fatalf("article wasn't archived")
+	}
+
+	html, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading snapshot: %s", err)
+	}
+
+	if strings.Contains(string(html), srv.URL) {
+		t.Errorf("snapshot still references the remote asset URL, rewriteAssetURLs' result wasn't saved:\n%s", html)
+	}
+}
@@ -0,0 +1,171 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"redaer/store"
+)
+
+// contentCandidates are the tags we'll consider as the root of an
+// article's main content.  None is preferred over another; extractContent
+// picks purely by text length.
+var contentCandidates = map[string]bool{
+	"article": true,
+	"main":    true,
+	"section": true,
+	"div":     true,
+}
+
+// extractContent runs a Readability-style heuristic over an HTML page:
+// the element among contentCandidates with the most text underneath it
+// wins, and is re-rendered standalone as the article body.  Falls back
+// to the whole document if nothing obviously better is found.
+func extractContent(page []byte) ([]byte, error) {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil, err
+	}
+
+	best := doc
+	bestLen := 0
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && contentCandidates[n.Data] {
+			if l := textLen(n); l > bestLen {
+				best, bestLen = n, l
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	var buf bytes.Buffer
+	buf.WriteString("<!doctype html>\n<html><head><meta charset=\"utf-8\"></head><body>\n")
+	if err := html.Render(&buf, best); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n</body></html>\n")
+	return buf.Bytes(), nil
+}
+
+// textLen returns the total length of the text nodes under n.
+func textLen(n *html.Node) int {
+	total := 0
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			total += len(strings.TrimSpace(n.Data))
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return total
+}
+
+// assetAttrs maps the tags whose asset URL we rewrite/download to the
+// attribute the URL lives in.
+var assetAttrs = map[string]string{
+	"img":    "src",
+	"link":   "href",
+	"script": "src",
+}
+
+// rewriteAssetURLs parses content, rewrites every img/link/script URL to
+// be absolute (via store.ForceAbsolute) and, budget permitting,
+// downloads it into dir and points the attribute at the local copy
+// instead.  Returns the re-rendered document.  Asset downloads go
+// through store.Get, so they're canceled by ctx and rate limited by
+// hosts the same as every other fetch in the pipeline.
+func rewriteAssetURLs(ctx context.Context, content []byte, baseUrl string, client *http.Client, hosts *store.HostLimiters, dir string, budget *int64) []byte {
+	doc, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		// Leave the snapshot as fetched rather than failing the whole archive.
+		return content
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if attrName, ok := assetAttrs[n.Data]; ok {
+				rewriteOne(ctx, n, attrName, baseUrl, client, hosts, dir, budget)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return content
+	}
+	return buf.Bytes()
+}
+
+func rewriteOne(ctx context.Context, n *html.Node, attrName, baseUrl string, client *http.Client, hosts *store.HostLimiters, dir string, budget *int64) {
+	for i, attr := range n.Attr {
+		if attr.Key != attrName || attr.Val == "" {
+			continue
+		}
+
+		abs, err := store.ForceAbsolute(baseUrl, attr.Val)
+		if err != nil {
+			continue
+		}
+		n.Attr[i].Val = abs
+
+		if *budget <= 0 {
+			continue
+		}
+		if local, ok := downloadAsset(ctx, client, hosts, abs, dir, budget); ok {
+			n.Attr[i].Val = local
+		}
+	}
+}
+
+// downloadAsset fetches url into a content-hashed file under dir,
+// deducting what it wrote from budget.  Returns the path relative to dir
+// to use in place of the original URL, or ok=false if it couldn't be
+// fetched within budget.
+func downloadAsset(ctx context.Context, client *http.Client, hosts *store.HostLimiters, url, dir string, budget *int64) (string, bool) {
+	resp, err := store.Get(ctx, client, hosts, url)
+	if err != nil {
+		return "", false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", false
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, *budget+1))
+	if err != nil || len(data) == 0 || int64(len(data)) > *budget {
+		return "", false
+	}
+
+	sum := sha256.Sum256([]byte(url))
+	name := hex.EncodeToString(sum[:])[:16] + filepath.Ext(url)
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		log.Printf("archive: writing asset %s: %s\n", url, err)
+		return "", false
+	}
+
+	*budget -= int64(len(data))
+	return name, true
+}
@@ -1,124 +1,153 @@
 package links
 
 import (
-	"encoding/xml"
 	"fmt"
 	"io"
+
+	"golang.org/x/net/html"
 )
 
 // Link extracted from a HTML file.
 type Link struct {
 	Title string
 	Url   string
+	// Rel holds the tag's rel attribute verbatim (e.g. "alternate"),
+	// empty if absent.
+	Rel string
+	// Type holds the tag's type attribute verbatim (e.g.
+	// "application/rss+xml"), empty if absent.
+	Type string
 }
 
-// Extracts all links from HTML produced by SRC.  Returns
-// the complete list, or just an error if there is a problem
-// parsing.
-// We recognize the xml parser sucks at parsing some in the wild
-// HTML, and so will return partial results even when we have
-// a parse error.
-func Extract(src io.Reader) (v []Link, err error) {
-	ring := xml.NewDecoder(src)
-	ring.Strict = false
-	ring.AutoClose = xml.HTMLAutoClose
-	ring.Entity = xml.HTMLEntity
-
-	return parseLinks(ring)
-}
-
-func parseLinks(d *xml.Decoder) (v []Link, err error) {
+// Extracts links from LINK and A tags from html source.
+// If an error occurs, all of the links parsed up to the error
+// position are returned as well.
+func Extract(in io.Reader) ([]Link, error) {
+	parser := html.NewTokenizer(in)
 	rv := make([]Link, 0)
+	var err error
 	for {
-		t, err := d.Token()
-
-		if err == io.EOF {
-			return rv, nil
-		}
-
-		if err != nil {
-			return rv, err
-		}
-
-		switch t := t.(type) {
-		case xml.StartElement:
-			if t.Name.Local == "a" || isLinkTagWithHREF(t) {
-				lnk, err := parseLink(d, t)
-				if err != nil {
-					return rv, err
-				}
-				rv = append(rv, lnk)
+		ty := parser.Next()
+		switch ty {
+		case html.ErrorToken:
+			err = parser.Err()
+			if err == io.EOF {
+				return rv, nil
+			} else {
+				return rv, err
+			}
+		case html.SelfClosingTagToken, html.StartTagToken:
+			tok := parser.Token()
+			rv, err = checkTag(tok, parser, rv)
+			if err != nil {
+				return rv, err
 			}
 		}
 	}
 }
 
-func extractAttr(t xml.StartElement, name string) string {
-	for _, attr := range t.Attr {
-		if attr.Name.Local == name {
-			return attr.Value
+func checkTag(startTok html.Token, parser *html.Tokenizer, links []Link) ([]Link, error) {
+	if startTok.Data == "a" && startTok.Type == html.StartTagToken {
+		return checkForAnchor(startTok, parser, links)
+	} else if startTok.Data == "link" {
+		lnk, ok := checkForLINK(startTok)
+		if ok {
+			return append(links, lnk), nil
 		}
 	}
-
-	return ""
+	return links, nil
 }
 
-func extractHREF(t xml.StartElement) string {
-	return extractAttr(t, "href")
-}
-
-func isLinkTagWithHREF(t xml.StartElement) bool {
-	return t.Name.Local == "link" && extractHREF(t) != ""
-}
-
-func parseLink(d *xml.Decoder, anchor xml.StartElement) (Link, error) {
-
-	url := extractHREF(anchor)
-	if url == "" {
-		return Link{}, fmt.Errorf("No href attribute (%s)", anchor)
+func checkForAnchor(startTok html.Token, parser *html.Tokenizer, links []Link) ([]Link, error) {
+	if startTok.Data != "a" {
+		return links, nil
 	}
 
-	title := "Some Lunk"
-	var err error
-
-	if anchor.Name.Local == "link" {
-		title = extractAttr(anchor, "type")
-	} else {
-		title, err = extractTitleCData(d)
-		if err != nil {
-			return Link{}, fmt.Errorf("Could not extract title for %s", url)
-		}
+	href, ok := findAttr(startTok.Attr, "href")
+	if !ok {
+		return links, nil
 	}
 
-	return Link{Title: title, Url: url}, nil
-}
-
-func extractTitleCData(d *xml.Decoder) (string, error) {
+	lnk := Link{Url: href.Val}
+	if rel, ok := findAttr(startTok.Attr, "rel"); ok {
+		lnk.Rel = rel.Val
+	}
+	if ty, ok := findAttr(startTok.Attr, "type"); ok {
+		lnk.Type = ty.Val
+	}
 	depth := 0
-	rv := ""
+
+tokLoop:
 	for {
-		t, err := d.Token()
-		if err != nil {
-			return "", fmt.Errorf("Error extracting title: %s", err)
-		}
+		ty := parser.Next()
+		switch ty {
+		case html.ErrorToken:
+			err := parser.Err()
+			if err == io.EOF {
+				return links, fmt.Errorf("EOF while parsing anchor body.")
+			}
+			return links, err
 
-		switch t := t.(type) {
-		case xml.StartElement:
+		case html.StartTagToken:
 			depth++
-		case xml.EndElement:
+
+		case html.EndTagToken:
 			depth--
-			if depth == -1 && t.Name.Local == "a" {
-				return rv, nil
-			}
+			// At this point, we're at the right level. If the HTML
+			// is mismatched, and this isn't an 'a' tag, we still want
+			// to break out here.  Not treating it as an error for now.
 			if depth < 0 {
-				return "", fmt.Errorf("Mismatched close tags for anchor?")
+				break tokLoop
 			}
 
-		case xml.CharData:
-			// We're collecting cdata at all depths, so something like
-			// "Jorb <abbr title="A Big Toad">ABT</abbr>" would be elided to
-			// "Jorb ABT".
-			rv += string(t)
+		case html.TextToken:
+			tok := parser.Token()
+			lnk.Title += tok.Data
+		}
+	}
+
+	// If there's no text data, check for title attribute as a last ditch effort.
+	if lnk.Title == "" {
+		title, ok := findAttr(startTok.Attr, "title")
+		if ok {
+			lnk.Title = title.Val
+		} else {
+			return links, nil
+		}
+	}
+	return append(links, lnk), nil
+}
+
+func checkForLINK(tok html.Token) (Link, bool) {
+	if tok.Data != "link" {
+		return Link{}, false
+	}
+
+	href, ok := findAttr(tok.Attr, "href")
+	if !ok {
+		return Link{}, false
+	}
+
+	rv := Link{Url: href.Val,
+		Title: "Some Link"}
+	if tyattr, ok := findAttr(tok.Attr, "type"); ok {
+		// Legacy quirk: Title doubles as the type for <link> tags, since
+		// they have no body text of their own. namedLikeFeedLink relies
+		// on this to substring-match e.g. "rss" in "application/rss+xml".
+		rv.Title = tyattr.Val
+		rv.Type = tyattr.Val
+	}
+	if relattr, ok := findAttr(tok.Attr, "rel"); ok {
+		rv.Rel = relattr.Val
+	}
+	return rv, true
+}
+
+func findAttr(attrs []html.Attribute, name string) (html.Attribute, bool) {
+	for _, att := range attrs {
+		if att.Key == name {
+			return att, true
 		}
 	}
+	return html.Attribute{}, false
 }
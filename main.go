@@ -1,25 +1,49 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/user"
 	"path"
+	"redaer/archive"
 	"redaer/links"
 	"redaer/store"
 )
 
 func main() {
+	opmlFile := flag.String("opml", "", "import subscriptions from this OPML file")
+	flag.Parse()
+
 	feedFile, err := UserFeedFile()
 	if err != nil {
 		log.Fatal("Couldn't locate home directory: %s", err)
 	}
 
+	archiveDir, err := UserArchiveDir()
+	if err != nil {
+		log.Fatal("Couldn't locate home directory: %s", err)
+	}
+
 	str, err := store.Load(feedFile)
 	if err != nil {
 		log.Fatalf("Could not load %s: %s", feedFile, err)
 	}
+	str.Archiver = archive.NewFileArchiver(archiveDir)
+
+	if *opmlFile != "" {
+		f, err := os.Open(*opmlFile)
+		if err != nil {
+			log.Fatalf("Could not open %s: %s", *opmlFile, err)
+		}
+		err = str.ImportOPML(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Could not import %s: %s", *opmlFile, err)
+		}
+	}
 
 	lnks, err := links.Extract(os.Stdin)
 	if err != nil {
@@ -29,10 +53,10 @@ func main() {
 	for _, lnk := range lnks {
 		str.InterestedIn(lnk.Url, lnk.Title)
 	}
-	str.CheckForUpdates()
+	str.CheckForUpdates(context.Background())
 
-	for _, lnk := range lnks {
-		details := str.Links[lnk.Url]
+	for _, url := range str.Subscriptions() {
+		details := str.Links[url]
 		if details.State != store.LinkHasFeed {
 			if details.LastError != nil {
 				fmt.Printf("<h1>%s</h1>\n", details.Title)
@@ -51,6 +75,9 @@ func main() {
 		// Feeds are in oldest first order.
 		for _, art := range unread {
 			fmt.Printf("<li><a href='%s'>%s</a>\n", art.Url, art.Title)
+			if art.ArchivePath != "" {
+				fmt.Printf("<a href='file://%s'>(cached copy)</a>\n", art.ArchivePath)
+			}
 		}
 		fmt.Printf("</ul>\n")
 		details.MarkAllAsRead()
@@ -67,3 +94,12 @@ func UserFeedFile() (string, error) {
 
 	return path.Join(u.HomeDir, "redaer.json"), nil
 }
+
+func UserArchiveDir() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(u.HomeDir, ".redaer-archive"), nil
+}
@@ -0,0 +1,66 @@
+// Package opml reads and writes OPML 2.0 documents, the format most
+// feed readers use to export and import their subscription lists.
+package opml
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// OPML is the root element of an OPML 2.0 document.
+type OPML struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    Head     `xml:"head"`
+	Body    Body     `xml:"body"`
+}
+
+// Head carries the document-level metadata we bother to round-trip.
+type Head struct {
+	Title string `xml:"title,omitempty"`
+}
+
+// Body holds the top-level outlines.
+type Body struct {
+	Outlines []Outline `xml:"outline"`
+}
+
+// Outline is either a feed subscription (XMLURL set) or a category
+// folder grouping other outlines (XMLURL empty, Outlines set).
+type Outline struct {
+	Text    string `xml:"text,attr"`
+	Title   string `xml:"title,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	XMLURL  string `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL string `xml:"htmlUrl,attr,omitempty"`
+	// Ignored is "true" for a feed the subscriber has asked to stop
+	// seeing, so other readers round-tripping this file know to leave
+	// it alone rather than re-offering it.
+	Ignored  string    `xml:"ignored,attr,omitempty"`
+	Outlines []Outline `xml:"outline"`
+}
+
+// Parse reads an OPML 2.0 document from r.
+func Parse(r io.Reader) (*OPML, error) {
+	var doc OPML
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// Write serializes doc as an OPML 2.0 document to w.
+func (doc *OPML) Write(w io.Writer) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,112 @@
+package store
+
+/*
+ OPML import/export for LinkStore subscriptions.
+*/
+import (
+	"io"
+
+	"redaer/opml"
+)
+
+// ImportOPML reads an OPML 2.0 document from r and registers every
+// outline with an xmlUrl as a link we already know the feed for, so no
+// discovery round-trip is needed, and marks it InterestedIn so the next
+// CheckForUpdates actually polls it.  Nested outlines without an xmlUrl
+// are treated as category folders and recorded on Category.  An outline
+// marked ignored="true" is imported as LinkIgnore; reimporting one
+// without that marking un-ignores it and reinstates LinkHasFeed even if
+// a previous check had left it LinkNoFeedFound or LinkTransientError.
+func (ls *LinkStore) ImportOPML(r io.Reader) error {
+	doc, err := opml.Parse(r)
+	if err != nil {
+		return MkError("ImportOPML: %s", err)
+	}
+
+	ls.importOutlines(doc.Body.Outlines, nil)
+	return nil
+}
+
+func (ls *LinkStore) importOutlines(outlines []opml.Outline, category []string) {
+	for _, o := range outlines {
+		if o.XMLURL == "" {
+			ls.importOutlines(o.Outlines, append(category, o.Text))
+			continue
+		}
+
+		title := o.Title
+		if title == "" {
+			title = o.Text
+		}
+
+		baseUrl := o.HTMLURL
+		if baseUrl == "" {
+			baseUrl = o.XMLURL
+		}
+
+		ls.InterestedIn(baseUrl, title)
+		ld := ls.Links[baseUrl]
+		ld.FeedUrl = o.XMLURL
+		ld.Category = append([]string(nil), category...)
+
+		// A reimport always knows better than whatever state a previous
+		// check or import left this link in: it's either being
+		// (re)ignored, or it's handed us a FeedUrl we should trust.
+		if o.Ignored == "true" {
+			ld.State = LinkIgnore
+		} else {
+			ld.State = LinkHasFeed
+		}
+	}
+}
+
+// ExportOPML writes every link we've resolved a feed for as an OPML 2.0
+// document to w, nesting outlines under their Category path and marking
+// LinkIgnore feeds ignored="true" so other readers importing this file
+// know to leave them alone.
+func (ls *LinkStore) ExportOPML(w io.Writer) error {
+	doc := &opml.OPML{Version: "2.0", Head: opml.Head{Title: "redaer subscriptions"}}
+
+	for _, ld := range ls.Links {
+		if ld.FeedUrl == "" {
+			// Never resolved to a feed; nothing useful to hand another reader.
+			continue
+		}
+
+		leaf := opml.Outline{
+			Text:    ld.Title,
+			Title:   ld.Title,
+			Type:    "rss",
+			XMLURL:  ld.FeedUrl,
+			HTMLURL: ld.BaseUrl,
+		}
+		if ld.State == LinkIgnore {
+			leaf.Ignored = "true"
+		}
+
+		doc.Body.Outlines = appendUnderCategory(doc.Body.Outlines, ld.Category, leaf)
+	}
+
+	return doc.Write(w)
+}
+
+// appendUnderCategory inserts leaf into outlines at the nested path
+// given by category, creating folder outlines for any path segment that
+// doesn't already exist.
+func appendUnderCategory(outlines []opml.Outline, category []string, leaf opml.Outline) []opml.Outline {
+	if len(category) == 0 {
+		return append(outlines, leaf)
+	}
+
+	head, rest := category[0], category[1:]
+	for i := range outlines {
+		if outlines[i].XMLURL == "" && outlines[i].Text == head {
+			outlines[i].Outlines = appendUnderCategory(outlines[i].Outlines, rest, leaf)
+			return outlines
+		}
+	}
+
+	folder := opml.Outline{Text: head}
+	folder.Outlines = appendUnderCategory(folder.Outlines, rest, leaf)
+	return append(outlines, folder)
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testOPML = `<?xml version="1.0" encoding="UTF-8"?>
+<opml version="2.0">
+  <head><title>subs</title></head>
+  <body>
+    <outline text="Tech">
+      <outline text="Example" title="Example" type="rss"
+        xmlUrl="http://example.com/feed.xml" htmlUrl="http://example.com/"/>
+    </outline>
+  </body>
+</opml>
+`
+
+func TestImportOPMLNotesAndResolvesFeed(t *testing.T) {
+	ls := newStore()
+
+	if err := ls.ImportOPML(strings.NewReader(testOPML)); err != nil {
+		t.Fatalf("ImportOPML: %s", err)
+	}
+
+	ld, ok := ls.Links["http://example.com/"]
+	if !ok {
+		t.Fatalf("import didn't register http://example.com/")
+	}
+	if ld.FeedUrl != "http://example.com/feed.xml" {
+		t.Errorf("FeedUrl = %q, want http://example.com/feed.xml", ld.FeedUrl)
+	}
+	if ld.State != LinkHasFeed {
+		t.Errorf("State = %v, want LinkHasFeed", ld.State)
+	}
+	if want := []string{"Tech"}; len(ld.Category) != 1 || ld.Category[0] != want[0] {
+		t.Errorf("Category = %v, want %v", ld.Category, want)
+	}
+
+	noted := ls.Subscriptions()
+	if len(noted) != 1 || noted[0] != "http://example.com/" {
+		t.Errorf("Subscriptions() = %v, want imported link to be noted so it gets checked", noted)
+	}
+}
+
+func TestImportOPMLExportRoundTrip(t *testing.T) {
+	ls := newStore()
+	if err := ls.ImportOPML(strings.NewReader(testOPML)); err != nil {
+		t.Fatalf("ImportOPML: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := ls.ExportOPML(&buf); err != nil {
+		t.Fatalf("ExportOPML: %s", err)
+	}
+
+	out := newStore()
+	if err := out.ImportOPML(&buf); err != nil {
+		t.Fatalf("reimporting our own export: %s", err)
+	}
+
+	ld, ok := out.Links["http://example.com/"]
+	if !ok {
+		t.Fatalf("export/reimport dropped http://example.com/")
+	}
+	if ld.FeedUrl != "http://example.com/feed.xml" {
+		t.Errorf("FeedUrl = %q after round-trip, want http://example.com/feed.xml", ld.FeedUrl)
+	}
+	if len(ld.Category) != 1 || ld.Category[0] != "Tech" {
+		t.Errorf("Category = %v after round-trip, want [Tech]", ld.Category)
+	}
+}
+
+func TestReimportTogglesIgnoreState(t *testing.T) {
+	ls := newStore()
+	if err := ls.ImportOPML(strings.NewReader(testOPML)); err != nil {
+		t.Fatalf("ImportOPML: %s", err)
+	}
+
+	ignored := strings.Replace(testOPML, `type="rss"`, `type="rss" ignored="true"`, 1)
+	if err := ls.ImportOPML(strings.NewReader(ignored)); err != nil {
+		t.Fatalf("reimporting as ignored: %s", err)
+	}
+	if got := ls.Links["http://example.com/"].State; got != LinkIgnore {
+		t.Fatalf("State after ignored reimport = %v, want LinkIgnore", got)
+	}
+
+	// A previously-unresolvable link should also recover once a reimport
+	// hands it a fresh FeedUrl, the same as un-ignoring one.
+	ls.Links["http://example.com/"].State = LinkNoFeedFound
+	if err := ls.ImportOPML(strings.NewReader(testOPML)); err != nil {
+		t.Fatalf("reimporting a LinkNoFeedFound link: %s", err)
+	}
+	if got := ls.Links["http://example.com/"].State; got != LinkHasFeed {
+		t.Fatalf("State after reimporting a LinkNoFeedFound link = %v, want LinkHasFeed", got)
+	}
+}
@@ -0,0 +1,54 @@
+package store
+
+/*
+ Per-host rate limiting, shared by every worker in CheckForUpdates so
+ polling several feeds on the same domain concurrently doesn't hammer it.
+*/
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// perHostRate/perHostBurst bound how fast we'll hit any single host,
+// independent of how many feeds on that host happen to be getting
+// checked at once.
+const (
+	perHostRate  = 1 // requests per second
+	perHostBurst = 2
+)
+
+// HostLimiters hands out a rate.Limiter per host, lazily, shared across
+// every CheckForUpdates worker goroutine.
+type HostLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func NewHostLimiters() *HostLimiters {
+	return &HostLimiters{limiters: make(map[string]*rate.Limiter)}
+}
+
+// Wait blocks until rawUrl's host is allowed to be hit again, or ctx is
+// canceled.  URLs we can't parse a host out of aren't rate limited.
+func (h *HostLimiters) Wait(ctx context.Context, rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	return h.limiterFor(u.Host).Wait(ctx)
+}
+
+func (h *HostLimiters) limiterFor(host string) *rate.Limiter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.limiters[host]
+	if !ok {
+		l = rate.NewLimiter(perHostRate, perHostBurst)
+		h.limiters[host] = l
+	}
+	return l
+}
@@ -1,13 +1,24 @@
 package store
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
+// DefaultConcurrency and DefaultPerRequestTimeout are used by
+// CheckForUpdates when LinkStore.Concurrency / PerRequestTimeout are
+// left at their zero value.
+const (
+	DefaultConcurrency       = 8
+	DefaultPerRequestTimeout = 30 * time.Second
+)
+
 type LinkState int
 
 const (
@@ -28,6 +39,13 @@ type Article struct {
 	Url     string
 	Title   string
 	PubDate time.Time
+	// Author as reported by the feed, empty if it didn't say.
+	Author string
+	// Set by a "star" FeedRule that matched this article.
+	Starred bool
+	// Local path to a cached, readable snapshot of this article, set by
+	// an Archiver.  Empty if the article hasn't been archived (yet).
+	ArchivePath string
 }
 type ArticleArray []Article
 
@@ -38,6 +56,10 @@ type LinkDetails struct {
 	State LinkState
 	// If State == LinkHasFeed, this contains the URL for the feed xml file.
 	FeedUrl string
+	// Format of FeedUrl as detected on the last successful check, so later
+	// checks can skip re-sniffing the Content-type.  Empty until the first
+	// successful check.
+	FeedFormat FeedFormat
 	// Last error encountered if State == LinkTransientError
 	LastError error `json:"-"`
 	// Title presented to the user for this link.
@@ -50,6 +72,58 @@ type LinkDetails struct {
 	// All of the known articles seen at the last CheckUpdates() call, in ascending order by
 	// PubDate.
 	Articles ArticleArray `json:"-"`
+	// ETag from the last successful feed fetch, sent back as
+	// If-None-Match so an unchanged feed can short-circuit with a 304.
+	ETag string
+	// Last-Modified from the last successful feed fetch, sent back as
+	// If-Modified-Since alongside ETag.
+	LastModified string
+	// Rolling estimate of how often this feed publishes, derived from an
+	// exponential moving average of the gaps between consecutive
+	// article PubDates.  Drives how far out NextCheck gets scheduled.
+	AvgPublishGap time.Duration
+	// Next time checkLink should bother re-fetching this feed's
+	// articles.  Zero means "check it now."
+	NextCheck time.Time
+	// Consecutive failed checks since the last success, used to back
+	// NextCheck off further each time a feed stays broken.
+	ConsecutiveErrors int
+	// Nested category path this feed was filed under the last time it
+	// was imported from or exported to OPML, outermost folder first.
+	Category []string
+	// Rules applied to this feed's articles: drop/mark-read filter out
+	// of UnreadArticles, star and rewrite-title apply as soon as an
+	// article is parsed.  See FeedRule.
+	Rules []FeedRule
+	// Shorthand for the common case of a single allow-list rule: if set,
+	// only articles whose title contains TitleFilter (case-insensitive)
+	// are returned by UnreadArticles.  Equivalent to a "drop" FeedRule
+	// that matches everything except TitleFilter, spelled out because
+	// whitelisting one keyword is the overwhelmingly common case.
+	TitleFilter string
+	// Maps an Article's Url to the local path of its archived snapshot.
+	// Survives across checks even though Articles itself is rebuilt from
+	// scratch on every poll, so an Archiver only has to fetch each
+	// article once.
+	Archived map[string]string
+}
+
+// Archiver fetches and caches the full content of articles so they stay
+// readable even if the source disappears.  Implementations live outside
+// this package (e.g. redaer/archive) to avoid this package depending on
+// how a snapshot is produced or stored.
+type Archiver interface {
+	// Archive is called once per link, after a successful
+	// checkForArticles, from the same goroutine that performed the
+	// check -- implementations that want to limit concurrency should
+	// rely on CheckForUpdates' own worker pool rather than spinning up
+	// another one.  client and hosts are the same ones CheckForUpdates
+	// used for the check itself (client.Timeout already set to
+	// PerRequestTimeout), so implementations should fetch through them
+	// rather than a client of their own, keeping archiving subject to
+	// the same cancellation and per-host rate limiting as everything
+	// else.  Canceling ctx should stop any fetches in progress.
+	Archive(ctx context.Context, client *http.Client, hosts *HostLimiters, link *LinkDetails) error
 }
 
 type LinkStore struct {
@@ -57,10 +131,22 @@ type LinkStore struct {
 	// ones that we've seen before, but ended up not having a feed we could find.
 	Links map[string]*LinkDetails
 
+	// If set, archives every newly-seen article after each successful check.
+	Archiver Archiver `json:"-"`
+
+	// How many links CheckForUpdates checks concurrently.  Zero means
+	// DefaultConcurrency; exposed so tests can drive it down to make
+	// scheduling deterministic.
+	Concurrency int
+	// Timeout applied to every HTTP request CheckForUpdates makes.  Zero
+	// means DefaultPerRequestTimeout.
+	PerRequestTimeout time.Duration
+
 	// BaseUrl for links we are interested in this session.
 	noted []string
 
 	client *http.Client
+	hosts  *HostLimiters
 }
 
 type ArticleClass int
@@ -79,7 +165,7 @@ const (
 //    for url := range configured {
 //       s.InterestedIn(url)
 //    }
-//    s.CheckForUpdates()
+//    s.CheckForUpdates(ctx)
 //    for url, details := range s.Links {
 //       for linkInfo := range details.Articles {
 //           ...
@@ -114,14 +200,38 @@ func Load(path string) (*LinkStore, error) {
 func (ld *LinkDetails) UnreadArticles() []Article {
 	rv := make([]Article, 0)
 	for _, art := range ld.Articles {
-		if ld.LastRead.Before(art.PubDate) {
-			rv = append(rv, art)
+		if !ld.LastRead.Before(art.PubDate) {
+			continue
 		}
+		if ld.filteredOut(art) {
+			continue
+		}
+		rv = append(rv, art)
 	}
 
 	return rv
 }
 
+// filteredOut reports whether art should be hidden from UnreadArticles,
+// per TitleFilter or a matching drop/mark-read FeedRule.
+func (ld *LinkDetails) filteredOut(art Article) bool {
+	if ld.TitleFilter != "" && !strings.Contains(strings.ToLower(art.Title), strings.ToLower(ld.TitleFilter)) {
+		return true
+	}
+
+	for i := range ld.Rules {
+		rule := &ld.Rules[i]
+		if rule.Action != RuleDrop && rule.Action != RuleMarkRead {
+			continue
+		}
+		if rule.Matches(&art) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (ld *LinkDetails) MarkAllAsRead() {
 	var latest time.Time
 	for _, art := range ld.Articles {
@@ -154,6 +264,7 @@ func (ls *LinkStore) Save(path string) error {
 func newStore() *LinkStore {
 	return &LinkStore{Links: map[string]*LinkDetails{},
 		client: &http.Client{},
+		hosts:  NewHostLimiters(),
 		noted:  make([]string, 0)}
 }
 
@@ -171,44 +282,67 @@ func (ls *LinkStore) InterestedIn(url, title string) {
 	ls.noted = append(ls.noted, url)
 }
 
+// Subscriptions returns the BaseUrl of every link InterestedIn() has
+// been called for this session, in the order it was noted, so callers
+// can drive CheckForUpdates' checked set (e.g. from an OPML import)
+// without reaching into LinkStore's internals.
+func (ls *LinkStore) Subscriptions() []string {
+	return append([]string(nil), ls.noted...)
+}
+
 // Checks the set of links InterestedIn() has been called for this
-// session for new articles.
-func (store *LinkStore) CheckForUpdates() {
-	const NumConcurrent = 8
+// session for new articles.  Canceling ctx stops workers from starting
+// any further HTTP requests and aborts ones in flight, since every
+// request is made with ctx.
+func (store *LinkStore) CheckForUpdates(ctx context.Context) {
+	concurrency := store.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	timeout := store.PerRequestTimeout
+	if timeout <= 0 {
+		timeout = DefaultPerRequestTimeout
+	}
+	store.client.Timeout = timeout
 
-	linkIn := make(chan *LinkDetails, NumConcurrent)
-	acks := make(chan int, len(store.noted))
+	linkIn := make(chan *LinkDetails, concurrency)
 
-	// Start the update routines.
-	for i := 0; i < NumConcurrent; i++ {
-		go checkLinkRoutine(store.client, linkIn, acks)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkLinkRoutine(ctx, store.client, store.Archiver, store.hosts, linkIn)
+		}()
 	}
 
-	// Feed the update routines the links.
+	// Feed the update routines the links, stopping early if ctx is canceled.
+feedLoop:
 	for _, base := range store.noted {
-		linkIn <- store.Links[base]
+		select {
+		case linkIn <- store.Links[base]:
+		case <-ctx.Done():
+			break feedLoop
+		}
 	}
-
-	// Close the link channel so the routines know no
-	// more work is coming.
 	close(linkIn)
 
-	// Wait for all routines to finish by receiving acks.
-	for i := 0; i < len(store.noted); i++ {
-		<-acks
-	}
+	wg.Wait()
 }
 
-func checkLinkRoutine(client *http.Client, linkIn <-chan *LinkDetails, acks chan<- int) {
+func checkLinkRoutine(ctx context.Context, client *http.Client, archiver Archiver, hosts *HostLimiters, linkIn <-chan *LinkDetails) {
 	for ld := range linkIn {
-		checkLink(client, ld)
-		acks <- 1
+		if ctx.Err() != nil {
+			return
+		}
+		checkLink(ctx, client, archiver, hosts, ld)
 	}
 }
 
 // Updates available articles for given link.
 // If the link is new, finds the feed URL as well.
-func checkLink(client *http.Client, ld *LinkDetails) {
+func checkLink(ctx context.Context, client *http.Client, archiver Archiver, hosts *HostLimiters, ld *LinkDetails) {
 	stateNeedsCheck := true
 	for stateNeedsCheck {
 		stateNeedsCheck = false
@@ -223,7 +357,7 @@ func checkLink(client *http.Client, ld *LinkDetails) {
 			}
 			stateNeedsCheck = true
 		case LinkIsNew:
-			feedUrl, err := findFeedUrl(client, ld)
+			feedUrl, err := findFeedUrl(ctx, client, hosts, ld)
 			if IsTransient(err) {
 				ld.ErrorOccurred(err)
 			} else if err != nil {
@@ -234,7 +368,16 @@ func checkLink(client *http.Client, ld *LinkDetails) {
 				stateNeedsCheck = true
 			}
 		case LinkHasFeed:
-			checkForArticles(client, ld)
+			if !ld.NextCheck.IsZero() && time.Now().Before(ld.NextCheck) {
+				log.Printf("\t%s: next check not due until %s, skipping.", ld.Title, ld.NextCheck)
+				break
+			}
+			checkForArticles(ctx, client, hosts, ld)
+			if ld.State == LinkHasFeed && archiver != nil {
+				if err := archiver.Archive(ctx, client, hosts, ld); err != nil {
+					log.Printf("archive %s: %s\n", ld.Title, err)
+				}
+			}
 		case LinkIgnore:
 			log.Printf("Ignoring %s...", ld.Title)
 		}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testFeedXML = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Test</title>
+<item><title>Hello</title><link>%s/article</link>
+<pubDate>Mon, 01 Jan 2024 00:00:00 GMT</pubDate></item>
+</channel></rss>`
+
+// TestCheckForUpdatesConcurrencyProcessesAllLinks drives CheckForUpdates
+// with Concurrency turned down, the scenario Concurrency's doc comment
+// says tests rely on for deterministic scheduling, and checks every
+// noted link still gets fetched and parsed.
+func TestCheckForUpdatesConcurrencyProcessesAllLinks(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprintf(w, testFeedXML, "http://example.com")
+	}))
+	defer srv.Close()
+
+	ls := newStore()
+	ls.Concurrency = 2
+	ls.PerRequestTimeout = 5 * time.Second
+
+	urls := []string{srv.URL + "/a", srv.URL + "/b", srv.URL + "/c"}
+	for i, u := range urls {
+		ls.InterestedIn(u, fmt.Sprintf("Feed %d", i))
+		ls.Links[u].State = LinkHasFeed
+		ls.Links[u].FeedUrl = u
+	}
+
+	ls.CheckForUpdates(context.Background())
+
+	if got := atomic.LoadInt32(&hits); got != int32(len(urls)) {
+		t.Errorf("server got %d hits, want %d", got, len(urls))
+	}
+	for _, u := range urls {
+		ld := ls.Links[u]
+		if len(ld.Articles) != 1 {
+			t.Errorf("%s: Articles = %d, want 1", u, len(ld.Articles))
+		}
+	}
+}
+
+// TestCheckForUpdatesStopsFeedingOnCanceledContext confirms a canceled
+// ctx stops CheckForUpdates from starting any new request, per its own
+// doc comment.
+func TestCheckForUpdatesStopsFeedingOnCanceledContext(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer srv.Close()
+
+	ls := newStore()
+	u := srv.URL + "/a"
+	ls.InterestedIn(u, "Feed")
+	ls.Links[u].State = LinkHasFeed
+	ls.Links[u].FeedUrl = u
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ls.CheckForUpdates(ctx)
+
+	if got := atomic.LoadInt32(&hits); got != 0 {
+		t.Errorf("server got %d hits after ctx was canceled before CheckForUpdates ran, want 0", got)
+	}
+}
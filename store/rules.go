@@ -0,0 +1,161 @@
+package store
+
+/*
+ Per-feed rules for filtering and annotating articles.
+*/
+import (
+	"regexp"
+	"strings"
+)
+
+// RuleAction is what a matching FeedRule does to an article.
+type RuleAction string
+
+const (
+	// RuleDrop hides the article from UnreadArticles entirely.
+	RuleDrop RuleAction = "drop"
+	// RuleMarkRead hides the article from UnreadArticles, same as
+	// RuleDrop; it exists as a separate action for rules that are
+	// describing "I've already seen these" rather than "I never want these".
+	RuleMarkRead RuleAction = "mark-read"
+	// RuleStar flags the article as Starred when parsed.
+	RuleStar RuleAction = "star"
+	// RuleRewriteTitle replaces Pattern with Replacement in the
+	// article's title when parsed.
+	RuleRewriteTitle RuleAction = "rewrite-title"
+)
+
+// MatchField is the Article field a FeedRule's Pattern is tested against.
+type MatchField string
+
+const (
+	MatchTitle  MatchField = "title"
+	MatchUrl    MatchField = "url"
+	MatchAuthor MatchField = "author"
+)
+
+// MatchMode is how a FeedRule's Pattern is interpreted.
+type MatchMode string
+
+const (
+	MatchSubstring MatchMode = "substring"
+	MatchGlob      MatchMode = "glob"
+	MatchRegexp    MatchMode = "regexp"
+)
+
+// FeedRule matches articles on Field using Mode, and applies Action to
+// anything that matches.  Rules round-trip through LinkDetails' normal
+// JSON (de)serialization via Save/Load, so no separate schema is needed.
+type FeedRule struct {
+	Field   MatchField
+	Mode    MatchMode
+	Pattern string
+	Action  RuleAction
+	// Replacement is used by RuleRewriteTitle: Pattern is replaced by
+	// Replacement (literal for substring/glob, capture-group aware for
+	// regexp) in the article's title.
+	Replacement string
+
+	compiled *regexp.Regexp
+}
+
+// Matches reports whether art satisfies the rule's Field/Mode/Pattern.
+func (r *FeedRule) Matches(art *Article) bool {
+	value := r.fieldValue(art)
+
+	switch r.Mode {
+	case MatchGlob, MatchRegexp:
+		re, err := r.regexp()
+		if err != nil {
+			return false
+		}
+		return re.MatchString(value)
+	default:
+		// Case-insensitive, matching the TitleFilter shorthand this mode
+		// is meant to be equivalent to.
+		return strings.Contains(strings.ToLower(value), strings.ToLower(r.Pattern))
+	}
+}
+
+func (r *FeedRule) fieldValue(art *Article) string {
+	switch r.Field {
+	case MatchUrl:
+		return art.Url
+	case MatchAuthor:
+		return art.Author
+	default:
+		return art.Title
+	}
+}
+
+// regexp returns r.Pattern compiled, translating it from a glob first if
+// Mode == MatchGlob.  Cached on first call since a FeedRule's Pattern
+// never changes after it's loaded.
+func (r *FeedRule) regexp() (*regexp.Regexp, error) {
+	if r.compiled == nil {
+		pattern := r.Pattern
+		if r.Mode == MatchGlob {
+			pattern = globToRegexp(pattern)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		r.compiled = re
+	}
+	return r.compiled, nil
+}
+
+// globToRegexp translates a shell-style glob (* and ? only, no character
+// classes) into an equivalent anchored regexp.  Unlike path.Match, * here
+// matches across "/" -- Url is a documented glob match field, and a
+// pattern like "*/sponsored/*" would otherwise silently never match a
+// multi-segment URL.
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// rewriteTitle applies a RuleRewriteTitle rule's Pattern/Replacement to
+// title.  Rules of any other Action should not be passed here.
+func (r *FeedRule) rewriteTitle(title string) string {
+	if r.Mode == MatchRegexp {
+		re, err := r.regexp()
+		if err != nil {
+			return title
+		}
+		return re.ReplaceAllString(title, r.Replacement)
+	}
+	return strings.Replace(title, r.Pattern, r.Replacement, -1)
+}
+
+// applyParseRules runs art through link's star and rewrite-title rules,
+// as soon as it comes back from an ArticleParser.  Drop/mark-read are
+// applied later, in UnreadArticles, since they depend on LastRead.
+func applyParseRules(link *LinkDetails, art *Article) {
+	for i := range link.Rules {
+		rule := &link.Rules[i]
+		if !rule.Matches(art) {
+			continue
+		}
+
+		switch rule.Action {
+		case RuleStar:
+			art.Starred = true
+		case RuleRewriteTitle:
+			art.Title = rule.rewriteTitle(art.Title)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package store
+
+import "testing"
+
+// TestGlobMatchCrossesPathSegments is a regression test for MatchGlob
+// using path.Match, whose "*" doesn't cross "/" -- a pattern like
+// "*/sponsored/*" against a multi-segment Url would then silently never
+// match.
+func TestGlobMatchCrossesPathSegments(t *testing.T) {
+	r := &FeedRule{Field: MatchUrl, Mode: MatchGlob, Pattern: "*/sponsored/*", Action: RuleDrop}
+
+	if !r.Matches(&Article{Url: "https://example.com/blog/sponsored/bar"}) {
+		t.Error("pattern */sponsored/* didn't match a URL with segments on both sides")
+	}
+	if r.Matches(&Article{Url: "https://example.com/blog/foo"}) {
+		t.Error("pattern */sponsored/* matched a URL that doesn't contain /sponsored/")
+	}
+}